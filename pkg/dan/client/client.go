@@ -0,0 +1,110 @@
+// Package client is the Go client library for pkg/dan's UDS runtime handoff
+// API, for VMM shims (Kata, Firecracker, ...) that want a pod's
+// DirectAttachableNetwork without re-parsing the metafile JSON themselves.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/dan"
+)
+
+// Client is a handle to a pkg/dan Serve endpoint. It holds no connection of
+// its own: GetNetwork and Watch each dial their own, since Serve's protocol
+// (see pkg/dan/wire.go) is one method per connection.
+type Client struct {
+	socket string
+}
+
+// Dial returns a Client for the DAN server listening on socket (a Unix
+// domain socket path, as passed to dan.Serve), after confirming the server
+// is actually reachable.
+func Dial(socket string) (*Client, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial DAN server at %q: %v", socket, err)
+	}
+	conn.Close()
+	return &Client{socket: socket}, nil
+}
+
+// Close is a no-op kept for API symmetry: Client holds no connection of its
+// own to release.
+func (c *Client) Close() error { return nil }
+
+// GetNetwork fetches the DirectAttachableNetwork most recently recorded for
+// containerID.
+func (c *Client) GetNetwork(ctx context.Context, containerID string) (*dan.DirectAttachableNetwork, error) {
+	conn, err := net.Dial("unix", c.socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial DAN server at %q: %v", c.socket, err)
+	}
+	defer conn.Close()
+
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+
+	req := dan.Request{Method: dan.MethodGetNetwork, ContainerID: containerID}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send GetNetwork request: %v", err)
+	}
+
+	var resp dan.Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read GetNetwork response: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return resp.Network, nil
+}
+
+// Watch streams every DAN create/delete dan.Event from the server until ctx
+// is canceled or the connection errors, at which point the returned channel
+// is closed.
+func (c *Client) Watch(ctx context.Context) (<-chan dan.Event, error) {
+	conn, err := net.Dial("unix", c.socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial DAN server at %q: %v", c.socket, err)
+	}
+
+	req := dan.Request{Method: dan.MethodWatch}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send Watch request: %v", err)
+	}
+
+	ch := make(chan dan.Event)
+	go func() {
+		defer close(ch)
+		defer conn.Close()
+
+		dec := json.NewDecoder(conn)
+		for {
+			var ev dan.Event
+			if err := dec.Decode(&ev); err != nil {
+				return
+			}
+
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Close the connection as soon as ctx is canceled, so the dec.Decode
+	// loop above unblocks instead of waiting on the server for the next
+	// event (or forever, if none ever comes).
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	return ch, nil
+}
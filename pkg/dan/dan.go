@@ -50,16 +50,6 @@ func FromResult(networkType DirectAttachableNetworkType, device, containerInfNam
 	return dan
 }
 
-func Log(format string, args ...interface{}) {
-	f, err := os.OpenFile("/tmp/cni.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		return
-	}
-
-	defer f.Close()
-	fmt.Fprintf(f, format+"\n", args...)
-}
-
 func (dan *DirectAttachableNetwork) Save(metaFile string) error {
 	body, _ := json.MarshalIndent(dan, "", " ")
 	path := filepath.Dir(metaFile)
@@ -68,3 +58,77 @@ func (dan *DirectAttachableNetwork) Save(metaFile string) error {
 	}
 	return os.WriteFile(metaFile, body, 0644)
 }
+
+// MetaFile returns the path a DAN plugin's metafile is stored at, keyed by
+// the plugin's metaDir (e.g. "tap", "dpdk", "passthrough") and a per-attachment
+// key: the host-side device name unless AddConfig.MetaKey sets another (tap
+// uses the container ID).
+func MetaFile(metaDir, deviceName string) string {
+	return filepath.Join("/tmp/dans", metaDir, deviceName+".json")
+}
+
+// Load reads back a metafile previously written by Save.
+func Load(metaFile string) (*DirectAttachableNetwork, error) {
+	body, err := os.ReadFile(metaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dan := &DirectAttachableNetwork{}
+	if err := json.Unmarshal(body, dan); err != nil {
+		return nil, fmt.Errorf("failed to parse DAN metafile %q: %v", metaFile, err)
+	}
+	return dan, nil
+}
+
+// indexDir holds one file per container ID recording that container's
+// current DAN attachment, so LoadByContainerID -- and Subscribe's poll loop,
+// which diffs indexDir's contents to synthesize create/delete Events -- can
+// find it without knowing which plugin (tap, dpdk, passthrough) or MetaKey
+// created the attachment.
+const indexDir = "/tmp/dans/index"
+
+// indexFile returns the path CmdAdd records a container ID's metafile path
+// under. This is what backs LoadByContainerID and, in turn, Serve's
+// GetNetwork RPC.
+func indexFile(containerID string) string {
+	return filepath.Join(indexDir, containerID+".json")
+}
+
+type indexEntry struct {
+	MetaFile string `json:"metaFile"`
+}
+
+// saveIndex records metaFile as containerID's attachment, overwriting any
+// earlier entry. A containerID with more than one DAN attachment (see
+// NetConf.Suffix) keeps only the most recently added one discoverable by
+// container ID alone; the others remain reachable by their own MetaKey.
+func saveIndex(containerID, metaFile string) error {
+	path := indexFile(containerID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	body, _ := json.Marshal(indexEntry{MetaFile: metaFile})
+	return os.WriteFile(path, body, 0644)
+}
+
+// removeIndex drops containerID's index entry, ignoring it already being
+// gone.
+func removeIndex(containerID string) {
+	_ = os.Remove(indexFile(containerID))
+}
+
+// LoadByContainerID resolves and loads the metafile CmdAdd most recently
+// recorded for containerID.
+func LoadByContainerID(containerID string) (*DirectAttachableNetwork, error) {
+	body, err := os.ReadFile(indexFile(containerID))
+	if err != nil {
+		return nil, err
+	}
+
+	var entry indexEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse DAN index for %q: %v", containerID, err)
+	}
+	return Load(entry.MetaFile)
+}
@@ -0,0 +1,112 @@
+package dan
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType distinguishes the two lifecycle events Watch synthesizes for
+// Serve's Watch subscribers.
+type EventType int
+
+const (
+	EventCreated EventType = iota
+	EventDeleted
+)
+
+// Event is what a Subscribe channel delivers.
+type Event struct {
+	Type        EventType                `json:"type"`
+	ContainerID string                   `json:"containerId"`
+	Network     *DirectAttachableNetwork `json:"network,omitempty"`
+}
+
+// indexPollInterval is how often Subscribe's poll loop rescans indexDir for
+// attachments coming and going. CmdAdd/CmdDel run in a short-lived plugin
+// process entirely separate from the long-lived Serve daemon, so there is
+// no in-process way to notify a Watch subscriber when one of them runs; the
+// two processes share nothing but the filesystem, so indexDir -- the same
+// directory LoadByContainerID already treats as the source of truth -- is
+// polled and diffed instead.
+const indexPollInterval = 1 * time.Second
+
+// Subscribe starts watching indexDir for attachments coming and going,
+// returning the channel Events are delivered on and a stop function the
+// caller must call once it's done watching. A subscriber that isn't keeping
+// up has events dropped for it rather than blocking the poll loop.
+func Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+	stop := make(chan struct{})
+	var once sync.Once
+
+	go pollIndex(ch, stop)
+
+	return ch, func() { once.Do(func() { close(stop) }) }
+}
+
+func pollIndex(ch chan<- Event, stop <-chan struct{}) {
+	defer close(ch)
+
+	prev := containerIDsInIndex()
+	ticker := time.NewTicker(indexPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			curr := containerIDsInIndex()
+			for id := range curr {
+				if _, ok := prev[id]; !ok {
+					meta, _ := LoadByContainerID(id)
+					if !sendEvent(ch, stop, Event{Type: EventCreated, ContainerID: id, Network: meta}) {
+						return
+					}
+				}
+			}
+			for id := range prev {
+				if _, ok := curr[id]; !ok {
+					if !sendEvent(ch, stop, Event{Type: EventDeleted, ContainerID: id}) {
+						return
+					}
+				}
+			}
+			prev = curr
+		}
+	}
+}
+
+// sendEvent delivers ev without blocking the poll loop: it is dropped if the
+// subscriber isn't keeping up, and sendEvent reports false once stop fires
+// so pollIndex can exit instead of polling a subscriber nobody reads from
+// anymore.
+func sendEvent(ch chan<- Event, stop <-chan struct{}, ev Event) bool {
+	select {
+	case ch <- ev:
+	case <-stop:
+		return false
+	default:
+	}
+	return true
+}
+
+// containerIDsInIndex lists the container IDs currently recorded in
+// indexDir.
+func containerIDsInIndex() map[string]struct{} {
+	ids := make(map[string]struct{})
+	entries, err := os.ReadDir(indexDir)
+	if err != nil {
+		return ids
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		ids[strings.TrimSuffix(name, ".json")] = struct{}{}
+	}
+	return ids
+}
@@ -0,0 +1,182 @@
+package dan
+
+import (
+	"errors"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/containernetworking/plugins/pkg/dan/log"
+	"github.com/containernetworking/plugins/pkg/ipam"
+)
+
+// AddConfig carries everything the shared CmdAdd needs to drive a single DAN
+// plugin invocation. Plugins (tap, dan-dpdk, dan-passthrough, ...) fill in
+// the network-type-specific parts via CreateDevice/Populate/DeleteDevice and
+// let CmdAdd handle the metafile lifecycle, IPAM invocation, and cleanup
+// deferral that would otherwise be duplicated in every plugin's main.go.
+type AddConfig struct {
+	NetworkType DirectAttachableNetworkType
+	// MetaDir is the subdirectory of /tmp/dans the metafile is written
+	// under, e.g. "tap", "dpdk", "passthrough".
+	MetaDir string
+	// MetaKey names the metafile within MetaDir. Defaults to the
+	// deviceName CreateDevice returns; plugins that key their metafile
+	// on something more stable than the device name (e.g. the container
+	// ID, so cmdDel can recompute the path without persisted state) set
+	// this explicitly.
+	MetaKey string
+	// ContainerID indexes the resulting metafile so Serve's GetNetwork RPC
+	// can find it without knowing MetaDir/MetaKey; see LoadByContainerID.
+	ContainerID string
+	IPAMType    string
+	StdinData   []byte
+	IfName      string
+	CNIVersion  string
+
+	// CreateDevice creates the network-type-specific device (tap link,
+	// vhost-user socket, vfio-pci binding, ...) and returns the CNI
+	// interface describing it plus the device name the metafile is
+	// keyed by and DeleteDevice is later called with.
+	CreateDevice func() (iface *current.Interface, deviceName string, err error)
+
+	// DeleteDevice rolls back CreateDevice when a later step of CmdAdd
+	// fails. It is called with the deviceName CreateDevice returned.
+	DeleteDevice func(deviceName string) error
+
+	// Populate fills in the network-type-specific DAN fields
+	// (DPDKSocketPath, PCIAddr/KernelPath, ...) on meta before it is
+	// persisted. May be nil if the interface and device name CreateDevice
+	// returns already say it all.
+	Populate func(meta *DirectAttachableNetwork)
+}
+
+// DelConfig carries everything the shared CmdDel needs to tear down a single
+// DAN plugin invocation.
+type DelConfig struct {
+	IPAMType    string
+	StdinData   []byte
+	DeviceName  string
+	ContainerID string
+
+	// DeleteDevice removes the device created by the matching CmdAdd.
+	DeleteDevice func(deviceName string) error
+}
+
+// CmdAdd runs the IPAM/device/metafile sequence shared by all DAN plugins:
+// create the device, invoke IPAM, merge the result, and persist a metafile
+// describing the attachment, rolling back the device and the IPAM
+// allocation if any step fails.
+func CmdAdd(cfg *AddConfig) (err error) {
+	if cfg.IPAMType == "" {
+		return errors.New("DAN interface requires an IPAM configuration")
+	}
+
+	iface, deviceName, err := cfg.CreateDevice()
+	if err != nil {
+		return err
+	}
+
+	metaKey := cfg.MetaKey
+	if metaKey == "" {
+		metaKey = deviceName
+	}
+
+	result := &current.Result{}
+	metaFile := MetaFile(cfg.MetaDir, metaKey)
+	defer func() {
+		// A failed CmdAdd has already rolled the device back below; don't
+		// persist a metafile (or index it) describing an attachment that
+		// doesn't exist.
+		if err != nil {
+			return
+		}
+
+		meta := FromResult(cfg.NetworkType, deviceName, cfg.IfName, result)
+		if cfg.Populate != nil {
+			cfg.Populate(meta)
+		}
+		_ = meta.Save(metaFile)
+
+		if cfg.ContainerID != "" {
+			_ = saveIndex(cfg.ContainerID, metaFile)
+		}
+	}()
+
+	// Delete the device if a later step fails, to avoid a device leak. This
+	// must not reassign the named err: it runs before the metafile defer
+	// above (defers are LIFO), so overwriting err with DeleteDevice's result
+	// -- nil on a clean rollback -- would erase the very failure that
+	// triggered the rollback before that defer's err != nil check sees it.
+	defer func() {
+		if err != nil && cfg.DeleteDevice != nil {
+			_ = cfg.DeleteDevice(deviceName)
+		}
+	}()
+
+	r, err := ipam.ExecAdd(cfg.IPAMType, cfg.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// defer ipam deletion to avoid ip leak
+	defer func() {
+		if err != nil {
+			ipam.ExecDel(cfg.IPAMType, cfg.StdinData)
+		}
+	}()
+
+	result, err = current.NewResultFromResult(r)
+	if err != nil {
+		return err
+	}
+
+	if len(result.IPs) == 0 {
+		return errors.New("IPAM plugin returned missing IP config")
+	}
+
+	for _, ipc := range result.IPs {
+		// all addresses apply to the container-side interface
+		ipc.Interface = current.Int(0)
+	}
+
+	result.Interfaces = []*current.Interface{iface}
+	log.Debug("result %+v", result)
+	if result.Annotations == nil {
+		result.Annotations = make(map[string]string)
+	}
+	result.Annotations["metafile"] = metaFile
+
+	return types.PrintResult(result, cfg.CNIVersion)
+}
+
+// CmdDel runs the IPAM/device teardown sequence shared by all DAN plugins.
+func CmdDel(cfg *DelConfig) error {
+	if cfg.IPAMType != "" {
+		if err := ipam.ExecDel(cfg.IPAMType, cfg.StdinData); err != nil {
+			log.Warn("cmdDel ipam.ExecDel error %+v", err)
+			return err
+		}
+	}
+
+	if err := cfg.DeleteDevice(cfg.DeviceName); err != nil {
+		// if NetNs is passed down by the Cloud Orchestration Engine, or if it
+		// called multiple times so don't return an error if the device is
+		// already removed.
+		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			if cfg.ContainerID != "" {
+				removeIndex(cfg.ContainerID)
+			}
+			return nil
+		}
+		return err
+	}
+
+	if cfg.ContainerID != "" {
+		removeIndex(cfg.ContainerID)
+	}
+
+	return nil
+}
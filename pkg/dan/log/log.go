@@ -0,0 +1,155 @@
+// Package log provides the level-based logging shared by the DAN family of
+// CNI plugins (tap, dan-dpdk, dan-passthrough). Unlike a bare fmt.Fprintf to
+// a hardcoded path, it is configured per invocation from NetConf's LogFile
+// and LogLevel fields, following the convention used by the containernetworking
+// reference plugins and multus-cni.
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Level controls which calls are written out. Higher values are more
+// verbose; a Logger drops any call more verbose than its configured level.
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+// ParseLevel maps a NetConf LogLevel string ("debug", "warn", "error", ...)
+// to a Level, defaulting to LevelInfo for an empty or unrecognized value.
+func ParseLevel(s string) Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug
+	case "warn", "warning":
+		return LevelWarn
+	case "error":
+		return LevelError
+	default:
+		return LevelInfo
+	}
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "INFO"
+	}
+}
+
+// maxLogSize is the size a log file is allowed to grow to before New
+// truncates it on next open; plugins run too briefly to rotate logs
+// themselves, so this keeps a long-lived host from accumulating unbounded
+// CNI logs.
+const maxLogSize = 10 * 1024 * 1024
+
+// Logger is a small level-filtered writer. The zero value is not usable;
+// construct one with New or NewWithSink.
+type Logger struct {
+	mu       sync.Mutex
+	sink     io.Writer
+	level    Level
+	closable bool
+}
+
+// NewWithSink builds a Logger writing to an arbitrary sink, e.g. a
+// *bytes.Buffer in tests, bypassing the file-handling New does. The sink is
+// never closed by Close, since NewWithSink callers (stderr fallbacks, test
+// buffers) don't own the sink's lifecycle.
+func NewWithSink(sink io.Writer, level Level) *Logger {
+	return &Logger{sink: sink, level: level}
+}
+
+// New opens logFile for pluginName at logLevel, truncating it first if it
+// has grown past maxLogSize, and falls back to stderr if logFile can't be
+// opened. An empty logFile is replaced with a per-plugin-unique default
+// under /tmp so concurrent tap/dpdk/passthrough invocations don't
+// interleave writes into a shared log file.
+func New(pluginName, logFile, logLevel string) *Logger {
+	if logFile == "" {
+		logFile = fmt.Sprintf("/tmp/cni-%s.log", pluginName)
+	}
+
+	if fi, err := os.Stat(logFile); err == nil && fi.Size() > maxLogSize {
+		_ = os.Remove(logFile)
+	}
+
+	level := ParseLevel(logLevel)
+
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return NewWithSink(os.Stderr, level)
+	}
+	logger := NewWithSink(f, level)
+	logger.closable = true
+	return logger
+}
+
+// Close releases the underlying sink, if it supports closing. It is a no-op
+// for Loggers built via NewWithSink (including New's os.Stderr fallback),
+// since those don't own their sink: closing os.Stderr out from under the
+// process would take down every other consumer's stderr output with it.
+func (l *Logger) Close() error {
+	if !l.closable {
+		return nil
+	}
+	if c, ok := l.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if level > l.level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.sink, "%s %s\n", level, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Debug(format string, args ...interface{}) { l.log(LevelDebug, format, args...) }
+func (l *Logger) Info(format string, args ...interface{})  { l.log(LevelInfo, format, args...) }
+func (l *Logger) Warn(format string, args ...interface{})  { l.log(LevelWarn, format, args...) }
+func (l *Logger) Error(format string, args ...interface{}) { l.log(LevelError, format, args...) }
+
+var (
+	defaultMu sync.Mutex
+	def       = NewWithSink(os.Stderr, LevelInfo)
+)
+
+// Configure replaces the package-level default Logger, used by the
+// Debug/Info/Warn/Error package functions. Plugins call this once they've
+// parsed NetConf's LogFile/LogLevel, before any other logging call.
+func Configure(pluginName, logFile, logLevel string) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	_ = def.Close()
+	def = New(pluginName, logFile, logLevel)
+}
+
+func current() *Logger {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return def
+}
+
+func Debug(format string, args ...interface{}) { current().Debug(format, args...) }
+func Info(format string, args ...interface{})  { current().Info(format, args...) }
+func Warn(format string, args ...interface{})  { current().Warn(format, args...) }
+func Error(format string, args ...interface{}) { current().Error(format, args...) }
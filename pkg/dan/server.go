@@ -0,0 +1,106 @@
+package dan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/dan/log"
+)
+
+// Serve starts the DAN server listening on socket (a Unix domain socket
+// path), blocking until the listener is closed. See wire.go for the
+// protocol it speaks. The on-disk metafile stays the source of truth:
+// GetNetwork re-reads it on every call, and Watch is driven by polling the
+// index directory CmdAdd/CmdDel already maintain (see Subscribe), since
+// CmdAdd/CmdDel run in a separate, short-lived plugin process with no
+// in-process way to reach this long-lived daemon.
+func Serve(socket string) error {
+	if err := os.RemoveAll(socket); err != nil {
+		return fmt.Errorf("failed to remove stale socket %q: %v", socket, err)
+	}
+
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", socket, err)
+	}
+
+	log.Info("dan: serving on %s", socket)
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go handleConn(conn)
+	}
+}
+
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.Debug("dan: failed to decode request from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	switch req.Method {
+	case MethodGetNetwork:
+		handleGetNetwork(conn, req.ContainerID)
+	case MethodWatch:
+		handleWatch(conn)
+	default:
+		writeResponse(conn, Response{Error: fmt.Sprintf("unknown method %q", req.Method)})
+	}
+}
+
+func handleGetNetwork(conn net.Conn, containerID string) {
+	meta, err := LoadByContainerID(containerID)
+	if err != nil {
+		writeResponse(conn, Response{Error: fmt.Sprintf("no DAN attachment found for container %q: %v", containerID, err)})
+		return
+	}
+	writeResponse(conn, Response{Network: meta})
+}
+
+func writeResponse(conn net.Conn, resp Response) {
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+// handleWatch streams Events to conn until the subscriber either errors out
+// or the peer disconnects. Since this protocol runs over a plain net.Conn
+// rather than a gRPC stream, disconnection isn't a context being canceled;
+// it's detected by a background read that blocks until it gets an error,
+// so a client going away promptly stops the Subscribe poll loop behind ch
+// instead of leaking it until the next event happens to fire.
+func handleWatch(conn net.Conn) {
+	ch, unsubscribe := Subscribe()
+	defer unsubscribe()
+
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package dan
+
+// Serve and pkg/dan/client speak a small newline-delimited JSON protocol
+// over their Unix domain socket rather than gRPC/protobuf, so neither side
+// needs a protoc toolchain or an extra module dependency just to move a
+// struct that's already JSON-tagged for the on-disk metafile. A client
+// writes one Request line and then either reads one Response line
+// (MethodGetNetwork) or keeps decoding one Event per line until it
+// disconnects (MethodWatch).
+
+const (
+	// MethodGetNetwork looks up a single container's DirectAttachableNetwork.
+	MethodGetNetwork = "GetNetwork"
+	// MethodWatch subscribes to every DAN attachment created or deleted
+	// from then on.
+	MethodWatch = "Watch"
+)
+
+// Request is the single line of JSON a client sends to open an RPC.
+type Request struct {
+	Method      string `json:"method"`
+	ContainerID string `json:"containerId,omitempty"`
+}
+
+// Response is MethodGetNetwork's single-line JSON reply.
+type Response struct {
+	Network *DirectAttachableNetwork `json:"network,omitempty"`
+	Error   string                   `json:"error,omitempty"`
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 Arista Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/containernetworking/plugins/pkg/dan"
+	"github.com/containernetworking/plugins/pkg/dan/log"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+type NetConf struct {
+	types.NetConf
+	// OVSBridge is the OVS-DPDK bridge the vhost-user port is attached to.
+	OVSBridge string `json:"ovsBridge"`
+	// SocketDir is the directory the vhost-user client socket is created
+	// in, defaults to /var/run/openvswitch.
+	SocketDir string `json:"socketDir"`
+
+	// LogFile and LogLevel configure this plugin's logging; see package
+	// dan/log. LogFile defaults to a per-plugin file under /tmp, LogLevel
+	// to "info".
+	LogFile  string `json:"logFile"`
+	LogLevel string `json:"logLevel"`
+}
+
+func parseNetConf(bytes []byte) (*NetConf, error) {
+	conf := &NetConf{SocketDir: "/var/run/openvswitch"}
+	if err := json.Unmarshal(bytes, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network config: %v", err)
+	}
+
+	if conf.OVSBridge == "" {
+		return nil, fmt.Errorf("\"ovsBridge\" field is required")
+	}
+
+	log.Configure("dan-dpdk", conf.LogFile, conf.LogLevel)
+	return conf, nil
+}
+
+// portName derives a deterministic, host-unique vhost-user port name from
+// the container ID, so a second pod on the same host doesn't collide.
+func portName(containerID string) string {
+	return fmt.Sprintf("dpdk-%.8s", containerID)
+}
+
+// createVhostUserPort adds a dpdkvhostuserclient port to the OVS-DPDK bridge
+// and returns its vhost-server-path: OVS connects to that socket as the
+// vhost-user client, so the VMM serves the vhost-user server side there.
+func createVhostUserPort(conf *NetConf, ifName string) (*current.Interface, string, error) {
+	socketPath := filepath.Join(conf.SocketDir, ifName)
+
+	cmd := exec.Command("ovs-vsctl", "add-port", conf.OVSBridge, ifName,
+		"--", "set", "Interface", ifName, "type=dpdkvhostuserclient",
+		fmt.Sprintf("options:vhost-server-path=%s", socketPath))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, "", fmt.Errorf("failed to add dpdkvhostuserclient port %q to bridge %q: %v: %s", ifName, conf.OVSBridge, err, out)
+	}
+
+	return &current.Interface{Name: ifName}, socketPath, nil
+}
+
+// deleteVhostUserPort removes the vhost-user port created by
+// createVhostUserPort, treating it already being gone as success.
+func deleteVhostUserPort(conf *NetConf, ifName string) error {
+	cmd := exec.Command("ovs-vsctl", "--if-exists", "del-port", conf.OVSBridge, ifName)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove port %q from bridge %q: %v: %s", ifName, conf.OVSBridge, err, out)
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	log.Debug("dan-dpdk conf %+v", conf)
+
+	ifName := portName(args.ContainerID)
+	var socketPath string
+
+	return dan.CmdAdd(&dan.AddConfig{
+		NetworkType: dan.DirectAttachableNetworkTypeDPDK,
+		MetaDir:     "dpdk",
+		ContainerID: args.ContainerID,
+		IPAMType:    conf.IPAM.Type,
+		StdinData:   args.StdinData,
+		IfName:      args.IfName,
+		CNIVersion:  conf.CNIVersion,
+		CreateDevice: func() (*current.Interface, string, error) {
+			iface, socket, err := createVhostUserPort(conf, ifName)
+			if err != nil {
+				return nil, "", err
+			}
+			socketPath = socket
+			return iface, ifName, nil
+		},
+		Populate: func(meta *dan.DirectAttachableNetwork) {
+			meta.DPDKSocketPath = socketPath
+		},
+		DeleteDevice: func(deviceName string) error {
+			return deleteVhostUserPort(conf, deviceName)
+		},
+	})
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	log.Debug("dan-dpdk cmdDel conf %+v", conf)
+
+	return dan.CmdDel(&dan.DelConfig{
+		IPAMType:    conf.IPAM.Type,
+		StdinData:   args.StdinData,
+		DeviceName:  portName(args.ContainerID),
+		ContainerID: args.ContainerID,
+		DeleteDevice: func(deviceName string) error {
+			return deleteVhostUserPort(conf, deviceName)
+		},
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("dan-dpdk"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	log.Debug("dan-dpdk cmdCheck conf %+v", conf)
+
+	return nil
+}
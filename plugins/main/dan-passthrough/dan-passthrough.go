@@ -0,0 +1,208 @@
+// Copyright 2022 Arista Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/containernetworking/plugins/pkg/dan"
+	"github.com/containernetworking/plugins/pkg/dan/log"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	pciDevicesPath      = "/sys/bus/pci/devices"
+	pciDriversProbePath = "/sys/bus/pci/drivers_probe"
+	vfioPCIDriver       = "vfio-pci"
+)
+
+type NetConf struct {
+	types.NetConf
+	// PCIAddr is the PCI address (e.g. "0000:03:00.0") of the device to
+	// bind to vfio-pci and pass through to the container.
+	PCIAddr string `json:"pciAddr"`
+
+	// LogFile and LogLevel configure this plugin's logging; see package
+	// dan/log. LogFile defaults to a per-plugin file under /tmp, LogLevel
+	// to "info".
+	LogFile  string `json:"logFile"`
+	LogLevel string `json:"logLevel"`
+}
+
+func parseNetConf(bytes []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(bytes, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network config: %v", err)
+	}
+
+	if conf.PCIAddr == "" {
+		return nil, fmt.Errorf("\"pciAddr\" field is required")
+	}
+
+	log.Configure("dan-passthrough", conf.LogFile, conf.LogLevel)
+	return conf, nil
+}
+
+// deviceName derives a filesystem/metafile-safe name from a PCI address
+// such as "0000:03:00.0".
+func deviceName(pciAddr string) string {
+	return strings.ReplaceAll(pciAddr, ":", "-")
+}
+
+// currentDriver returns the kernel driver name a PCI device is currently
+// bound to, or "" if it isn't bound to any driver.
+func currentDriver(pciAddr string) (string, error) {
+	link, err := os.Readlink(filepath.Join(pciDevicesPath, pciAddr, "driver"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read current driver for %s: %v", pciAddr, err)
+	}
+	return filepath.Base(link), nil
+}
+
+// bindVFIOPCI unbinds a PCI device from its current driver (if any) and
+// binds it to vfio-pci, returning the original driver name so cmdDel can
+// restore it later.
+func bindVFIOPCI(pciAddr string) (origDriver string, err error) {
+	origDriver, err = currentDriver(pciAddr)
+	if err != nil {
+		return "", err
+	}
+
+	overridePath := filepath.Join(pciDevicesPath, pciAddr, "driver_override")
+	if err := os.WriteFile(overridePath, []byte(vfioPCIDriver), 0o200); err != nil {
+		return "", fmt.Errorf("failed to set driver_override on %s: %v", pciAddr, err)
+	}
+
+	if origDriver != "" {
+		unbindPath := filepath.Join(pciDevicesPath, pciAddr, "driver", "unbind")
+		if err := os.WriteFile(unbindPath, []byte(pciAddr), 0o200); err != nil {
+			return "", fmt.Errorf("failed to unbind %s from %s: %v", pciAddr, origDriver, err)
+		}
+	}
+
+	if err := os.WriteFile(pciDriversProbePath, []byte(pciAddr), 0o200); err != nil {
+		return "", fmt.Errorf("failed to bind %s to %s: %v", pciAddr, vfioPCIDriver, err)
+	}
+
+	return origDriver, nil
+}
+
+// unbindVFIOPCI unbinds a PCI device from vfio-pci and rebinds it to
+// origDriver (or lets the kernel pick a driver again if origDriver is
+// empty), the reverse of bindVFIOPCI.
+func unbindVFIOPCI(pciAddr, origDriver string) error {
+	unbindPath := filepath.Join(pciDevicesPath, pciAddr, "driver", "unbind")
+	if err := os.WriteFile(unbindPath, []byte(pciAddr), 0o200); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to unbind %s from %s: %v", pciAddr, vfioPCIDriver, err)
+	}
+
+	overridePath := filepath.Join(pciDevicesPath, pciAddr, "driver_override")
+	if err := os.WriteFile(overridePath, []byte(origDriver), 0o200); err != nil {
+		return fmt.Errorf("failed to restore driver_override on %s: %v", pciAddr, err)
+	}
+
+	if err := os.WriteFile(pciDriversProbePath, []byte(pciAddr), 0o200); err != nil {
+		return fmt.Errorf("failed to rebind %s to %s: %v", pciAddr, origDriver, err)
+	}
+
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	log.Debug("dan-passthrough conf %+v", conf)
+
+	ifName := deviceName(conf.PCIAddr)
+	var origDriver string
+
+	return dan.CmdAdd(&dan.AddConfig{
+		NetworkType: dan.DirectAttachableNetworkTypePassthrough,
+		MetaDir:     "passthrough",
+		ContainerID: args.ContainerID,
+		IPAMType:    conf.IPAM.Type,
+		StdinData:   args.StdinData,
+		IfName:      args.IfName,
+		CNIVersion:  conf.CNIVersion,
+		CreateDevice: func() (*current.Interface, string, error) {
+			drv, err := bindVFIOPCI(conf.PCIAddr)
+			if err != nil {
+				return nil, "", err
+			}
+			origDriver = drv
+			return &current.Interface{Name: conf.PCIAddr}, ifName, nil
+		},
+		Populate: func(meta *dan.DirectAttachableNetwork) {
+			meta.PCIAddr = conf.PCIAddr
+			meta.KernelPath = origDriver
+		},
+		DeleteDevice: func(string) error {
+			return unbindVFIOPCI(conf.PCIAddr, origDriver)
+		},
+	})
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	log.Debug("dan-passthrough cmdDel conf %+v", conf)
+
+	// The original driver was only known to the cmdAdd invocation that
+	// bound this device, so recover it from the metafile it persisted.
+	origDriver := ""
+	if meta, err := dan.Load(dan.MetaFile("passthrough", deviceName(conf.PCIAddr))); err == nil {
+		origDriver = meta.KernelPath
+	}
+
+	return dan.CmdDel(&dan.DelConfig{
+		IPAMType:    conf.IPAM.Type,
+		StdinData:   args.StdinData,
+		DeviceName:  deviceName(conf.PCIAddr),
+		ContainerID: args.ContainerID,
+		DeleteDevice: func(string) error {
+			return unbindVFIOPCI(conf.PCIAddr, origDriver)
+		},
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("dan-passthrough"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	log.Debug("dan-passthrough cmdCheck conf %+v", conf)
+
+	return nil
+}
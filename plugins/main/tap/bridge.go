@@ -0,0 +1,265 @@
+// Copyright 2022 Arista Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/dan/log"
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+// defaultSubnetPool is the range DAN auto-allocates bridge /24 subnets from
+// when NetConf pins neither a Subnet nor a SubnetPool.
+const defaultSubnetPool = "192.168.0.0/16"
+
+// bridgeIPNet resolves the CIDR address the bridge itself should hold:
+// conf.BridgeIP verbatim if set, otherwise the first usable address of
+// conf.Subnet, or of a /24 auto-allocated out of conf.SubnetPool (or
+// defaultSubnetPool) that doesn't collide with an existing route.
+func bridgeIPNet(conf *NetConf) (*net.IPNet, error) {
+	if conf.BridgeIP != "" {
+		ip, ipNet, err := net.ParseCIDR(conf.BridgeIP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bridge IP(%+v): %v", conf.BridgeIP, err)
+		}
+		// net.ParseCIDR's second return value is the masked network
+		// address, not the host address conf.BridgeIP actually names (e.g.
+		// "10.0.0.1/24" parses to (10.0.0.1, 10.0.0.0/24)); the bridge must
+		// get the host address or cmdCheck's later compare against the
+		// literal conf.BridgeIP can never match.
+		return &net.IPNet{IP: ip, Mask: ipNet.Mask}, nil
+	}
+
+	var subnet *net.IPNet
+	if conf.Subnet != "" {
+		_, parsed, err := net.ParseCIDR(conf.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse subnet %q: %v", conf.Subnet, err)
+		}
+		subnet = parsed
+	} else {
+		pool := conf.SubnetPool
+		if pool == "" {
+			pool = defaultSubnetPool
+		}
+		allocated, err := allocateSubnet(pool)
+		if err != nil {
+			return nil, err
+		}
+		subnet = allocated
+	}
+
+	gw := make(net.IP, len(subnet.IP))
+	copy(gw, subnet.IP)
+	gw[len(gw)-1] |= 1
+	return &net.IPNet{IP: gw, Mask: subnet.Mask}, nil
+}
+
+// existingBridgeIPNet reads the CIDR address already configured on br, for
+// the case where conf.Bridge names a bridge created by an earlier DAN
+// attachment: bridgeIPNet must not be called again here, since re-deriving
+// (or worse, re-allocating) an address for an already-up bridge can return
+// one that doesn't match what's actually on the wire, breaking cmdCheck and
+// IP masquerade teardown for this attachment forever.
+func existingBridgeIPNet(br netlink.Link) (*net.IPNet, error) {
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of bridge %q: %v", br.Attrs().Name, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("bridge %q already exists but has no IPv4 address configured", br.Attrs().Name)
+	}
+	return addrs[0].IPNet, nil
+}
+
+// allocateSubnet picks a /24 out of pool (an IPv4 network no smaller than
+// /24) that doesn't overlap any route already present on the host, so
+// several bridges can auto-allocate without colliding.
+func allocateSubnet(pool string) (*net.IPNet, error) {
+	_, poolNet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet pool %q: %v", pool, err)
+	}
+	ones, bits := poolNet.Mask.Size()
+	base := poolNet.IP.To4()
+	if bits != 32 || base == nil || ones > 24 {
+		return nil, fmt.Errorf("subnet pool %q must be an IPv4 network no smaller than /24", pool)
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	// Each /24 candidate is base + i*256 in the 32-bit address space, not
+	// just base's third octet + i: a pool wider than /16 (e.g. 10.0.0.0/8,
+	// which the check above allows) has more than 256 /24s in it, and
+	// varying only one byte would wrap back to the start of the pool long
+	// before numSubnets candidates had actually been tried.
+	baseInt := binary.BigEndian.Uint32(base)
+	numSubnets := 1 << uint(24-ones)
+	for i := 0; i < numSubnets; i++ {
+		candidate := make(net.IP, 4)
+		binary.BigEndian.PutUint32(candidate, baseInt+uint32(i)*256)
+		sub := &net.IPNet{IP: candidate.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+
+		conflict := false
+		for _, r := range routes {
+			if r.Dst != nil && (r.Dst.Contains(sub.IP) || sub.Contains(r.Dst.IP)) {
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			return sub, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free /24 subnet available in pool %q", pool)
+}
+
+// bridgeRefCountDir holds one file per bridge recording how many DAN tap
+// attachments currently depend on that bridge's ip_forward/MASQUERADE
+// setup, so cmdDel only tears it down once the last attachment is gone --
+// even though the bridge itself may be shared by other pods.
+const bridgeRefCountDir = "/tmp/dans/tap/refcount"
+
+func bridgeRefCountFile(bridge string) string {
+	return filepath.Join(bridgeRefCountDir, bridge+".count")
+}
+
+func readBridgeRefCount(bridge string) (int, error) {
+	body, err := os.ReadFile(bridgeRefCountFile(bridge))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		return 0, fmt.Errorf("corrupt refcount file for bridge %q: %v", bridge, err)
+	}
+	return n, nil
+}
+
+func writeBridgeRefCount(bridge string, n int) error {
+	if err := os.MkdirAll(bridgeRefCountDir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(bridgeRefCountFile(bridge), []byte(strconv.Itoa(n)), 0o644)
+}
+
+// lockBridgeRefCount takes an exclusive flock on bridge's refcount lock file,
+// so concurrent cmdAdd/cmdDel invocations attaching to (or detaching from) a
+// shared bridge serialize their read-modify-write of the ref count instead of
+// racing and losing increments/decrements. The caller must unlockBridgeRefCount
+// the returned file once its read-modify-write is done.
+func lockBridgeRefCount(bridge string) (*os.File, error) {
+	if err := os.MkdirAll(bridgeRefCountDir, 0o755); err != nil {
+		return nil, err
+	}
+	path := bridgeRefCountFile(bridge) + ".lock"
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open refcount lock for bridge %q: %v", bridge, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock refcount file for bridge %q: %v", bridge, err)
+	}
+	return f, nil
+}
+
+func unlockBridgeRefCount(f *os.File) {
+	_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	_ = f.Close()
+}
+
+// subnetOf masks ipn down to its network address, so the same rule spec is
+// used whether the caller passes a bridge's own host address or an already
+// masked subnet.
+func subnetOf(ipn *net.IPNet) *net.IPNet {
+	return &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask}
+}
+
+// setupIPMasq enables ipv4 forwarding and installs a MASQUERADE rule for
+// ipn's subnet the first time a bridge gains a DAN attachment that asked
+// for it; later attachments to the same bridge just bump the ref count.
+func setupIPMasq(bridge string, ipn *net.IPNet) error {
+	lock, err := lockBridgeRefCount(bridge)
+	if err != nil {
+		return err
+	}
+	defer unlockBridgeRefCount(lock)
+
+	n, err := readBridgeRefCount(bridge)
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		if err := ip.EnableIP4Forward(); err != nil {
+			return fmt.Errorf("failed to enable ipv4 forwarding: %v", err)
+		}
+		if err := ip.SetupIPMasq(subnetOf(ipn), bridge, false); err != nil {
+			return fmt.Errorf("failed to set up IP masquerade for %q: %v", bridge, err)
+		}
+	}
+
+	if err := writeBridgeRefCount(bridge, n+1); err != nil {
+		return fmt.Errorf("failed to record IP masquerade ref count for %q: %v", bridge, err)
+	}
+	return nil
+}
+
+// teardownIPMasq reverses setupIPMasq, removing the MASQUERADE rule only
+// once every DAN attachment that installed it has been torn down.
+func teardownIPMasq(bridge string, ipn *net.IPNet) error {
+	lock, err := lockBridgeRefCount(bridge)
+	if err != nil {
+		return err
+	}
+	defer unlockBridgeRefCount(lock)
+
+	n, err := readBridgeRefCount(bridge)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		log.Debug("no IP masquerade ref count recorded for bridge %q, nothing to tear down", bridge)
+		return nil
+	}
+
+	if n <= 1 {
+		_ = os.Remove(bridgeRefCountFile(bridge))
+		if err := ip.TeardownIPMasq(subnetOf(ipn), bridge, false); err != nil {
+			return fmt.Errorf("failed to tear down IP masquerade for %q: %v", bridge, err)
+		}
+		return nil
+	}
+
+	return writeBridgeRefCount(bridge, n-1)
+}
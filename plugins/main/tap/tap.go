@@ -16,7 +16,6 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net"
 
@@ -28,9 +27,9 @@ import (
 	"github.com/containernetworking/cni/pkg/version"
 
 	"github.com/containernetworking/plugins/pkg/dan"
+	"github.com/containernetworking/plugins/pkg/dan/log"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
-	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
 
@@ -39,6 +38,32 @@ type NetConf struct {
 	Bridge   string `json:"bridge"`
 	BridgeIP string `json:"bridgeIP"`
 	// MasterInterface string `json:"masterInterface"`
+
+	// IPMasq installs a MASQUERADE rule so traffic from the bridge
+	// subnet can reach the outside world through the host's other
+	// interfaces. HairpinMode lets one tap peer reach another through a
+	// port published on the host side of the bridge.
+	IPMasq      bool `json:"ipMasq"`
+	HairpinMode bool `json:"hairpinMode"`
+	// Subnet pins the bridge's subnet explicitly (e.g. "10.0.1.0/24"). If
+	// empty, a /24 is auto-allocated out of SubnetPool (defaults to
+	// 192.168.0.0/16) avoiding conflicts with existing routes. Ignored if
+	// BridgeIP is set.
+	Subnet     string `json:"subnet"`
+	SubnetPool string `json:"subnetPool"`
+
+	// HostInterfacePrefix overrides the default "tap" prefix used when
+	// deriving the host-side tap device name from the container ID.
+	HostInterfacePrefix string `json:"hostInterfacePrefix"`
+	// Suffix disambiguates multiple DAN tap attachments to the same
+	// sandbox, so a pod can be given more than one tap interface.
+	Suffix string `json:"suffix"`
+
+	// LogFile and LogLevel configure this plugin's logging; see package
+	// dan/log. LogFile defaults to a per-plugin file under /tmp, LogLevel
+	// to "info".
+	LogFile  string `json:"logFile"`
+	LogLevel string `json:"logLevel"`
 }
 
 func parseNetConf(bytes []byte) (*NetConf, error) {
@@ -46,13 +71,57 @@ func parseNetConf(bytes []byte) (*NetConf, error) {
 	if err := json.Unmarshal(bytes, conf); err != nil {
 		return nil, fmt.Errorf("failed to parse network config: %v", err)
 	}
+	log.Configure("tap", conf.LogFile, conf.LogLevel)
 	return conf, nil
 }
 
-func createTapInterface(conf *NetConf, ifName string) (*current.Interface, error) {
+// hostTapName derives the host-side tap device name deterministically from
+// the container ID (and an optional per-invocation suffix), so a second pod
+// -- or a second DAN attached to the same pod -- doesn't collide with an
+// existing "tap0". cmdAdd persists the result in the metafile's DeviceName
+// rather than relying on later invocations recomputing the same name.
+func hostTapName(conf *NetConf, containerID string) (string, error) {
+	prefix := conf.HostInterfacePrefix
+	if prefix == "" {
+		prefix = "tap"
+	}
+
+	name := fmt.Sprintf("%s-%.8s", prefix, containerID)
+	if conf.Suffix != "" {
+		name = fmt.Sprintf("%s-%s", name, conf.Suffix)
+	}
+
+	// Linux interface names are limited to IFNAMSIZ-1 (15) characters.
+	// Truncating here instead of erroring could silently collide two
+	// distinct Suffix values (or two container IDs) onto the same host tap
+	// name, so refuse it instead.
+	if len(name) > 15 {
+		return "", fmt.Errorf("derived tap device name %q exceeds the 15-character Linux interface name limit", name)
+	}
+	return name, nil
+}
+
+// metaKey names the metafile for a tap attachment. It is keyed on the
+// container ID rather than the tap device name so that, unlike the device
+// name, it stays stable even if HostInterfacePrefix changes between cmdAdd
+// and cmdDel.
+func metaKey(containerID, suffix string) string {
+	if suffix == "" {
+		return containerID
+	}
+	return fmt.Sprintf("%s-%s", containerID, suffix)
+}
+
+// createTapInterface creates (or reuses) the bridge and the host-side tap
+// link, returning the CNI interface describing the tap link and the bridge
+// IPNet so the caller can persist it for cmdDel to recover IPMasq state
+// from later.
+func createTapInterface(conf *NetConf, ifName string) (*current.Interface, *net.IPNet, error) {
 
 	tapInterface := &current.Interface{}
 
+	var ipNet *net.IPNet
+
 	br, err := netlink.LinkByName(conf.Bridge)
 	if err != nil {
 		if _, ok := err.(netlink.LinkNotFoundError); ok {
@@ -60,6 +129,11 @@ func createTapInterface(conf *NetConf, ifName string) (*current.Interface, error
 			// https://gist.github.com/extremecoders-re/e8fd8a67a515fee0c873dcafc81d811c?permalink_comment_id=4039841#gistcomment-4039841
 			// https://krackout.wordpress.com/2020/03/08/network-bridges-and-tun-tap-interfaces-in-linux/
 
+			ipNet, err = bridgeIPNet(conf)
+			if err != nil {
+				return nil, nil, err
+			}
+
 			br = &netlink.Bridge{
 				LinkAttrs: netlink.LinkAttrs{
 					Name: conf.Bridge,
@@ -67,20 +141,29 @@ func createTapInterface(conf *NetConf, ifName string) (*current.Interface, error
 			}
 
 			if err := netlink.LinkAdd(br); err != nil {
-				return nil, fmt.Errorf("failed to create bridge link: %v", err)
-			}
-
-			_, ipv4Net, err := net.ParseCIDR(conf.BridgeIP)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse bridge IP(%+v): %v", conf.BridgeIP, err)
+				return nil, nil, fmt.Errorf("failed to create bridge link: %v", err)
 			}
 
-			addr := &netlink.Addr{IPNet: ipv4Net, Label: ""}
+			addr := &netlink.Addr{IPNet: ipNet, Label: ""}
 			if err = netlink.AddrAdd(br, addr); err != nil {
-				return nil, fmt.Errorf("failed to add IP addr %v to %q: %v", ipv4Net, conf.Bridge, err)
+				return nil, nil, fmt.Errorf("failed to add IP addr %v to %q: %v", ipNet, conf.Bridge, err)
 			}
 		} else {
-			return nil, fmt.Errorf("failed to fetch master bridge device %q: %v", conf.Bridge, err)
+			return nil, nil, fmt.Errorf("failed to fetch master bridge device %q: %v", conf.Bridge, err)
+		}
+	} else {
+		// conf.Bridge already exists, e.g. set up by an earlier DAN
+		// attachment: use the address it was actually given rather than
+		// re-deriving or re-allocating one, which could disagree with it.
+		ipNet, err = existingBridgeIPNet(br)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if conf.IPMasq {
+		if err := setupIPMasq(conf.Bridge, ipNet); err != nil {
+			return nil, nil, err
 		}
 	}
 
@@ -92,153 +175,258 @@ func createTapInterface(conf *NetConf, ifName string) (*current.Interface, error
 	}
 
 	if err := netlink.LinkAdd(tap); err != nil {
-		return nil, fmt.Errorf("failed to create tap link: %v", err)
+		return nil, nil, fmt.Errorf("failed to create tap link: %v", err)
 	}
 	tapInterface.Name = ifName
 
 	// set master: `ip link set $link master $master`
 	if err := netlink.LinkSetMaster(tap, br); err != nil {
-		return nil, fmt.Errorf("failed to link tap device %q to master %+v: %v", ifName, br, err)
+		return nil, nil, fmt.Errorf("failed to link tap device %q to master %+v: %v", ifName, br, err)
+	}
+
+	if conf.HairpinMode {
+		if err := netlink.LinkSetHairpin(tap, true); err != nil {
+			return nil, nil, fmt.Errorf("failed to enable hairpin mode on %q: %v", ifName, err)
+		}
 	}
 
 	// Re-fetch interface to get all properties/attributes
 	tapGot, err := netlink.LinkByName(ifName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch tap device %q: %v", ifName, err)
+		return nil, nil, fmt.Errorf("failed to fetch tap device %q: %v", ifName, err)
 	}
-	dan.Log("tapGot %+v", tapGot)
+	log.Debug("tapGot %+v", tapGot)
 
 	tapInterface.Mac = tapGot.Attrs().HardwareAddr.String()
 
 	if err = netlink.LinkSetUp(tapGot); err != nil {
-		return nil, fmt.Errorf("failed to set %+v up: %v", tapGot, err)
+		return nil, nil, fmt.Errorf("failed to set %+v up: %v", tapGot, err)
+	}
+	return tapInterface, ipNet, nil
+}
+
+// deleteTapLink removes the host-side tap link, treating it already being
+// gone as success since cmdDel may be invoked more than once for the same
+// sandbox.
+func deleteTapLink(hostTapName string) error {
+	err := ip.DelLinkByName(hostTapName)
+	if err != nil && err == ip.ErrLinkNotFound {
+		log.Debug("cmdDel ip.DelLinkByName not found %+v", err)
+		return nil
 	}
-	return tapInterface, nil
+	return err
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
-	dan.Log(">>>>>>>>   cmdAdd   >>>>>>>>>>>>")
-	defer dan.Log(">>>>>>>>   cmdAdd   >>>>>>>>>>>>")
-	dan.Log("args %+v", args)
+	log.Debug(">>>>>>>>   cmdAdd   >>>>>>>>>>>>")
+	defer log.Debug(">>>>>>>>   cmdAdd   >>>>>>>>>>>>")
+	log.Debug("args %+v", args)
 
 	conf, err := parseNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
-	dan.Log("conf %+v", conf)
-
-	if conf.IPAM.Type == "" {
-		return errors.New("tap interface requires an IPAM configuration")
-	}
+	log.Debug("conf %+v", conf)
 
-	// FIXME now use fixed tap0 as host side interface
-	hostTapName := "tap0"
-	tapInterface, err := createTapInterface(conf, hostTapName)
+	hostTap, err := hostTapName(conf, args.ContainerID)
 	if err != nil {
 		return err
 	}
+	var bridgeSubnet *net.IPNet
+
+	return dan.CmdAdd(&dan.AddConfig{
+		NetworkType: dan.DirectAttachableNetworkTypeTap,
+		MetaDir:     "tap",
+		MetaKey:     metaKey(args.ContainerID, conf.Suffix),
+		ContainerID: args.ContainerID,
+		IPAMType:    conf.IPAM.Type,
+		StdinData:   args.StdinData,
+		IfName:      args.IfName,
+		CNIVersion:  conf.CNIVersion,
+		CreateDevice: func() (*current.Interface, string, error) {
+			tapInterface, ipNet, err := createTapInterface(conf, hostTap)
+			bridgeSubnet = ipNet
+			return tapInterface, hostTap, err
+		},
+		Populate: func(meta *dan.DirectAttachableNetwork) {
+			if bridgeSubnet == nil {
+				return
+			}
+			if meta.Annotations == nil {
+				meta.Annotations = make(map[string]string)
+			}
+			// bridgeIP records the address actually assigned to the
+			// bridge, so cmdCheck can still verify it even when
+			// BridgeIP was auto-allocated rather than pinned.
+			meta.Annotations["bridgeIP"] = bridgeSubnet.String()
+			if conf.IPMasq {
+				meta.Annotations["bridgeSubnet"] = subnetOf(bridgeSubnet).String()
+			}
+		},
+		DeleteDevice: func(deviceName string) error {
+			if conf.IPMasq && bridgeSubnet != nil {
+				if err := teardownIPMasq(conf.Bridge, bridgeSubnet); err != nil {
+					log.Warn("failed to roll back IP masquerade for bridge %q: %v", conf.Bridge, err)
+				}
+			}
+			return deleteTapLink(deviceName)
+		},
+	})
+}
 
-	result := &current.Result{}
-	metaFile := fmt.Sprintf("/tmp/dans/tap/%s.json", hostTapName)
-	defer func() {
-		meta := dan.FromResult(dan.DirectAttachableNetworkTypeTap, hostTapName, args.IfName, result)
-		_ = meta.Save(metaFile)
-	}()
-
-	// Delete link if err to avoid link leak in this ns
-	defer func() {
-		if err != nil {
-			err = ip.DelLinkByName(hostTapName)
-		}
-	}()
-
-	r, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+func cmdDel(args *skel.CmdArgs) error {
+	log.Debug(">>>>>>>>   cmdDel   >>>>>>>>>>>>")
+	defer log.Debug(">>>>>>>>   cmdDel   >>>>>>>>>>>>")
+	conf, err := parseNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
-
-	// defer ipam deletion to avoid ip leak
-	defer func() {
+	log.Debug("cmdDel conf %+v", conf)
+
+	// Recover the host tap name cmdAdd actually created from its metafile
+	// rather than recomputing hostTapName from conf: the two only agree if
+	// HostInterfacePrefix/Suffix are byte-for-byte identical between cmdAdd
+	// and cmdDel, which NetConf doesn't guarantee.
+	meta, metaErr := dan.Load(dan.MetaFile("tap", metaKey(args.ContainerID, conf.Suffix)))
+	deviceName := ""
+	if metaErr == nil {
+		deviceName = meta.DeviceName
+	} else {
+		hostTap, err := hostTapName(conf, args.ContainerID)
 		if err != nil {
-			ipam.ExecDel(conf.IPAM.Type, args.StdinData)
+			return err
 		}
-	}()
-
-	// convert IPAMResult to current Result type
-	result, err = current.NewResultFromResult(r)
-	if err != nil {
-		return err
+		deviceName = hostTap
 	}
 
-	if len(result.IPs) == 0 {
-		return errors.New("IPAM plugin returned missing IP config")
-	}
-
-	for _, ipc := range result.IPs {
-		// all addresses apply to the container tap interface
-		ipc.Interface = current.Int(0)
-	}
+	return dan.CmdDel(&dan.DelConfig{
+		IPAMType:    conf.IPAM.Type,
+		StdinData:   args.StdinData,
+		DeviceName:  deviceName,
+		ContainerID: args.ContainerID,
+		DeleteDevice: func(deviceName string) error {
+			if conf.IPMasq && metaErr == nil {
+				if subnet, ok := meta.Annotations["bridgeSubnet"]; ok {
+					if _, ipNet, err := net.ParseCIDR(subnet); err == nil {
+						if err := teardownIPMasq(conf.Bridge, ipNet); err != nil {
+							log.Warn("failed to tear down IP masquerade for bridge %q: %v", conf.Bridge, err)
+						}
+					}
+				}
+			}
+			return deleteTapLink(deviceName)
+		},
+	})
+}
 
-	result.Interfaces = []*current.Interface{tapInterface}
-	dan.Log("result %+v", result)
-	if result.Annotations == nil {
-		result.Annotations = make(map[string]string)
-	}
-	result.Annotations["metafile"] = metaFile
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("tap"))
+}
 
-	// if err := ipam.ConfigureIface(hostTapName, result); err != nil {
-	// 	return err
-	// }
+// errCodeStateDrift is a plugin-specific CNI error code (codes 100+ are
+// reserved for plugin use by the CNI spec) returned when the live kernel
+// state has drifted from what cmdAdd recorded in the DAN metafile.
+const errCodeStateDrift uint = 100
+
+// tapCheckState is the live-vs-recorded state cmdCheck gathers before
+// deciding whether the tap attachment still matches its metafile. It's
+// split out from cmdCheck so the decision logic can be tested without
+// real netlink/kernel objects.
+type tapCheckState struct {
+	linkFound   bool
+	mac         string
+	expectedMAC string
+	masterIndex int
+	bridgeIndex int
+	bridgeHasIP bool
+}
 
-	return types.PrintResult(result, conf.CNIVersion)
+// validateTapState turns a gathered tapCheckState into a CNI-spec error, or
+// nil if the live kernel objects still match what cmdAdd recorded.
+func validateTapState(hostTapName, bridge, bridgeIP string, s tapCheckState) error {
+	if !s.linkFound {
+		return types.NewError(errCodeStateDrift, fmt.Sprintf("tap link %q not found", hostTapName), "")
+	}
+	if s.mac != s.expectedMAC {
+		return types.NewError(errCodeStateDrift,
+			fmt.Sprintf("tap link %q MAC %q does not match recorded MAC %q", hostTapName, s.mac, s.expectedMAC), "")
+	}
+	if s.masterIndex != s.bridgeIndex {
+		return types.NewError(errCodeStateDrift,
+			fmt.Sprintf("tap link %q is not enslaved to bridge %q", hostTapName, bridge), "")
+	}
+	if !s.bridgeHasIP {
+		return types.NewError(errCodeStateDrift,
+			fmt.Sprintf("bridge %q does not hold the configured address %q", bridge, bridgeIP), "")
+	}
+	return nil
 }
 
-func cmdDel(args *skel.CmdArgs) error {
-	dan.Log(">>>>>>>>   cmdDel   >>>>>>>>>>>>")
-	defer dan.Log(">>>>>>>>   cmdDel   >>>>>>>>>>>>")
+func cmdCheck(args *skel.CmdArgs) error {
 	conf, err := parseNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
-	dan.Log(" cmdDel conf %+v", conf)
+	log.Debug("cmdCheck conf %+v", conf)
 
-	if err = ipam.ExecDel(conf.IPAM.Type, args.StdinData); err != nil {
-		dan.Log(" cmdDel ipam.ExecDel error %+v", err)
-		return err
+	meta, err := dan.Load(dan.MetaFile("tap", metaKey(args.ContainerID, conf.Suffix)))
+	if err != nil {
+		return types.NewError(types.ErrInvalidEnvironmentVariables, fmt.Sprintf("failed to load DAN metafile: %v", err), "")
 	}
-
-	// FIXME tap0
-	err = ip.DelLinkByName("tap0")
-	if err != nil && err == ip.ErrLinkNotFound {
-		dan.Log(" cmdDel ip.DelLinkByName not found %+v", err)
-		return nil
+	// Use the host tap name cmdAdd actually recorded rather than
+	// recomputing hostTapName from conf, which only agrees with it if
+	// HostInterfacePrefix/Suffix haven't changed since.
+	hostTap := meta.DeviceName
+
+	var expectedMAC string
+	if len(meta.Interfaces) > 0 {
+		expectedMAC = meta.Interfaces[0].Mac
 	}
-	dan.Log(" cmdDel tap0 deleted %+v", err)
 
-	if err != nil {
-		//  if NetNs is passed down by the Cloud Orchestration Engine, or if it called multiple times
-		// so don't return an error if the device is already removed.
-		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
-		_, ok := err.(ns.NSPathNotExistErr)
-		if ok {
-			return nil
-		}
-		return err
+	// BridgeIP may have been auto-allocated at cmdAdd time; fall back to
+	// what was actually recorded in the metafile rather than an empty
+	// configured value.
+	expectedBridgeIP := conf.BridgeIP
+	if expectedBridgeIP == "" {
+		expectedBridgeIP = meta.Annotations["bridgeIP"]
 	}
 
-	return nil
-}
+	state := tapCheckState{expectedMAC: expectedMAC}
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("tap"))
-}
+	if link, err := netlink.LinkByName(hostTap); err == nil {
+		state.linkFound = true
+		state.mac = link.Attrs().HardwareAddr.String()
+		state.masterIndex = link.Attrs().MasterIndex
+	} else if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return fmt.Errorf("failed to fetch tap device %q: %v", hostTap, err)
+	}
 
-func cmdCheck(args *skel.CmdArgs) error {
-	conf, err := parseNetConf(args.StdinData)
+	br, err := netlink.LinkByName(conf.Bridge)
+	if err != nil {
+		return fmt.Errorf("failed to fetch master bridge device %q: %v", conf.Bridge, err)
+	}
+	state.bridgeIndex = br.Attrs().Index
+
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
 	if err != nil {
+		return fmt.Errorf("failed to list addresses of bridge %q: %v", conf.Bridge, err)
+	}
+	for _, addr := range addrs {
+		if addr.IPNet != nil && addr.IPNet.String() == expectedBridgeIP {
+			state.bridgeHasIP = true
+			break
+		}
+	}
+
+	if err := validateTapState(hostTap, conf.Bridge, expectedBridgeIP, state); err != nil {
 		return err
 	}
-	dan.Log("cmdCheck conf %+v", conf)
+
+	if conf.IPAM.Type != "" {
+		if err := ipam.ExecCheck(conf.IPAM.Type, args.StdinData); err != nil {
+			return fmt.Errorf("IPAM check failed: %v", err)
+		}
+	}
 
 	return nil
 }
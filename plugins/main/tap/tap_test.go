@@ -0,0 +1,110 @@
+// Copyright 2022 Arista Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestValidateTapState(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   tapCheckState
+		wantErr bool
+	}{
+		{
+			name: "matches",
+			state: tapCheckState{
+				linkFound:   true,
+				mac:         "aa:bb:cc:dd:ee:ff",
+				expectedMAC: "aa:bb:cc:dd:ee:ff",
+				masterIndex: 3,
+				bridgeIndex: 3,
+				bridgeHasIP: true,
+			},
+			wantErr: false,
+		},
+		{
+			name: "missing link",
+			state: tapCheckState{
+				linkFound:   false,
+				expectedMAC: "aa:bb:cc:dd:ee:ff",
+				masterIndex: 3,
+				bridgeIndex: 3,
+				bridgeHasIP: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong master",
+			state: tapCheckState{
+				linkFound:   true,
+				mac:         "aa:bb:cc:dd:ee:ff",
+				expectedMAC: "aa:bb:cc:dd:ee:ff",
+				masterIndex: 4,
+				bridgeIndex: 3,
+				bridgeHasIP: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "mac mismatch",
+			state: tapCheckState{
+				linkFound:   true,
+				mac:         "11:22:33:44:55:66",
+				expectedMAC: "aa:bb:cc:dd:ee:ff",
+				masterIndex: 3,
+				bridgeIndex: 3,
+				bridgeHasIP: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "bridge missing configured IP",
+			state: tapCheckState{
+				linkFound:   true,
+				mac:         "aa:bb:cc:dd:ee:ff",
+				expectedMAC: "aa:bb:cc:dd:ee:ff",
+				masterIndex: 3,
+				bridgeIndex: 3,
+				bridgeHasIP: false,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTapState("tap-abcdef01", "br0", "10.0.0.1/24", tt.state)
+			if tt.wantErr && err == nil {
+				t.Fatalf("expected an error, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if err != nil {
+				cniErr, ok := err.(*types.Error)
+				if !ok {
+					t.Fatalf("expected a *types.Error, got %T", err)
+				}
+				if cniErr.Code != errCodeStateDrift {
+					t.Fatalf("expected error code %d, got %d", errCodeStateDrift, cniErr.Code)
+				}
+			}
+		})
+	}
+}